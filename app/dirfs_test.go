@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirFSResolveWithinRoot(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "sub", "existing.txt"), []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "existing.txt"), []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+
+	d := newDirFS(root)
+
+	t.Run("existing file within root", func(t *testing.T) {
+		if _, err := d.resolveWithinRoot("sub/existing.txt"); err != nil {
+			t.Fatalf("resolveWithinRoot() error = %v, want nil", err)
+		}
+	})
+
+	t.Run("new file within root", func(t *testing.T) {
+		if _, err := d.resolveWithinRoot("sub/new.txt"); err != nil {
+			t.Fatalf("resolveWithinRoot() error = %v, want nil", err)
+		}
+	})
+
+	t.Run("invalid fs path", func(t *testing.T) {
+		if _, err := d.resolveWithinRoot("../escape.txt"); err == nil {
+			t.Fatal("resolveWithinRoot(\"../escape.txt\") = nil error, want error")
+		}
+	})
+
+	t.Run("existing file behind escaping symlink", func(t *testing.T) {
+		if _, err := d.resolveWithinRoot("escape/existing.txt"); err == nil {
+			t.Fatal("resolveWithinRoot() = nil error, want error for symlink escape")
+		}
+	})
+
+	t.Run("new file behind escaping symlink", func(t *testing.T) {
+		if _, err := d.resolveWithinRoot("escape/new.txt"); err == nil {
+			t.Fatal("resolveWithinRoot() = nil error, want error for symlink escape")
+		}
+	})
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestChooseEncoding(t *testing.T) {
+	server := NewServer(nil)
+
+	tests := []struct {
+		name   string
+		header string
+		want   string // Name() of the chosen encoder, "" for nil
+	}{
+		{name: "no header", header: "", want: ""},
+		{name: "single encoding", header: "gzip", want: "gzip"},
+		{name: "highest q wins", header: "gzip;q=0.5, deflate;q=0.8", want: "deflate"},
+		{name: "unregistered encoding ignored", header: "zstd", want: ""},
+		{name: "identity is a no-op", header: "identity", want: ""},
+		{name: "q=0 rejects an encoding", header: "gzip;q=0", want: ""},
+		{name: "wildcard picks first unrejected", header: "*", want: "gzip"},
+		{name: "wildcard honors explicit rejection", header: "gzip;q=0, *", want: "deflate"},
+		{name: "zero-weight wildcard chooses nothing", header: "*;q=0", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := server.chooseEncoding(tt.header)
+			gotName := ""
+			if got != nil {
+				gotName = got.Name()
+			}
+			if gotName != tt.want {
+				t.Fatalf("chooseEncoding(%q) = %q, want %q", tt.header, gotName, tt.want)
+			}
+		})
+	}
+}
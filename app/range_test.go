@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestParseRangeHeader(t *testing.T) {
+	const size = int64(100)
+
+	tests := []struct {
+		name    string
+		header  string
+		want    [][2]int64
+		wantErr bool
+	}{
+		{name: "simple range", header: "bytes=0-49", want: [][2]int64{{0, 49}}},
+		{name: "open-ended range", header: "bytes=50-", want: [][2]int64{{50, 99}}},
+		{name: "suffix range", header: "bytes=-10", want: [][2]int64{{90, 99}}},
+		{name: "suffix range larger than size", header: "bytes=-1000", want: [][2]int64{{0, 99}}},
+		{name: "end clamped to size", header: "bytes=90-1000", want: [][2]int64{{90, 99}}},
+		{name: "multiple ranges", header: "bytes=0-9,20-29", want: [][2]int64{{0, 9}, {20, 29}}},
+		{name: "start beyond size dropped", header: "bytes=0-9,200-299", want: [][2]int64{{0, 9}}},
+		{name: "all ranges out of bounds", header: "bytes=200-299", want: [][2]int64{}},
+		{name: "unsupported unit", header: "items=0-9", wantErr: true},
+		{name: "missing dash", header: "bytes=10", wantErr: true},
+		{name: "empty spec", header: "bytes=-", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRangeHeader(tt.header, size)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseRangeHeader(%q) = %v, want error", tt.header, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRangeHeader(%q) returned unexpected error: %v", tt.header, err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseRangeHeader(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("parseRangeHeader(%q) = %v, want %v", tt.header, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -1,60 +1,384 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bufio"
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"io"
+	"io/fs"
+	"mime"
 	"net"
 	"net/http"
+	"net/http/httputil"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
 )
 
 const (
 	StatusOK                  = "200 OK"
 	StatusCreated             = "201 Created"
+	StatusNotModified         = "304 Not Modified"
 	StatusNotFound            = "404 Not Found"
+	StatusRangeNotSatisfiable = "416 Range Not Satisfiable"
 	StatusInternalServerError = "500 Internal Server Error"
+	StatusPartialContent      = "206 Partial Content"
 	contentTypePlainText      = "text/plain"
 	contentTypeOctetStream    = "application/octet-stream"
 	bufferSize                = 4096
+	multipartBoundary         = "3d6b6a416f9b5"
+
+	defaultIdleTimeout   = 60 * time.Second
+	defaultHeaderTimeout = 5 * time.Second
+	defaultWriteTimeout  = 30 * time.Second
 )
 
-func HttpResponse(conn net.Conn, status string, body []byte, contentType string, contentEncoding *string) {
+// precompressedSuffixes maps a negotiated Content-Encoding to the sibling
+// file suffix that holds a pre-compressed copy of a served file.
+var precompressedSuffixes = map[string]string{
+	"gzip": ".gz",
+	"br":   ".br",
+}
+
+// Encoder is a registrable Content-Encoding codec. Registering a new one (for
+// zstd, say) only requires implementing this interface and adding it to a
+// Server's encoder table; nothing else in the request path changes.
+type Encoder interface {
+	Name() string
+	NewWriter(w io.Writer) io.WriteCloser
+}
+
+type gzipEncoder struct{}
+
+func (gzipEncoder) Name() string                         { return "gzip" }
+func (gzipEncoder) NewWriter(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+
+type deflateEncoder struct{}
+
+func (deflateEncoder) Name() string { return "deflate" }
+func (deflateEncoder) NewWriter(w io.Writer) io.WriteCloser {
+	fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+	return fw
+}
+
+type brotliEncoder struct{}
+
+func (brotliEncoder) Name() string                         { return "br" }
+func (brotliEncoder) NewWriter(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) }
+
+// defaultEncoders lists the codecs a Server negotiates Accept-Encoding
+// against unless overridden with WithEncoders.
+func defaultEncoders() []Encoder {
+	return []Encoder{gzipEncoder{}, deflateEncoder{}, brotliEncoder{}}
+}
+
+// WriteFS extends fs.FS with the ability to create or overwrite a file,
+// letting the /files POST handler work against the same abstraction as
+// reads. Backends that are read-only (an embed.FS, for instance) simply
+// don't implement it, and uploads are rejected with 500.
+type WriteFS interface {
+	fs.FS
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+}
+
+// dirFS adapts a plain directory on disk into a WriteFS, backing reads with
+// os.DirFS and writes with os.WriteFile rooted at the same directory.
+type dirFS struct {
+	fs.FS
+	root string
+}
+
+func newDirFS(root string) *dirFS {
+	return &dirFS{FS: os.DirFS(root), root: root}
+}
+
+// resolveWithinRoot validates name the same way for every dirFS entry point:
+// it must be a syntactically safe fs.FS path (no "..", no absolute paths
+// after filepath.Clean), and no symlink component of it may resolve outside
+// root. Unlike a read, a write's target may not exist yet, so it walks up to
+// the nearest existing ancestor before checking for an escaping symlink. It
+// returns the joined on-disk path for the caller to use.
+func (d *dirFS) resolveWithinRoot(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	joined := filepath.Join(d.root, filepath.FromSlash(name))
+
+	checkPath := joined
+	for {
+		resolved, err := filepath.EvalSymlinks(checkPath)
+		if err == nil {
+			if rootResolved, err := filepath.EvalSymlinks(d.root); err == nil {
+				rel, err := filepath.Rel(rootResolved, resolved)
+				if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+					return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+				}
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			break
+		}
+		parent := filepath.Dir(checkPath)
+		if parent == checkPath {
+			break
+		}
+		checkPath = parent
+	}
+
+	return joined, nil
+}
+
+// Open overrides the embedded os.DirFS to run reads through
+// resolveWithinRoot before delegating.
+func (d *dirFS) Open(name string) (fs.File, error) {
+	if _, err := d.resolveWithinRoot(name); err != nil {
+		return nil, err
+	}
+	return d.FS.Open(name)
+}
+
+// WriteFile runs writes through the same resolveWithinRoot validation as
+// Open, so a symlink planted inside root can't be used to escape it on
+// write any more than it can on read.
+func (d *dirFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	joined, err := d.resolveWithinRoot(name)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(joined, data, perm)
+}
+
+// Server serves the codecrafters HTTP endpoints against an fs.FS-backed file
+// subsystem, so the backend can be swapped for an embed.FS, a test fake, or
+// any other implementation without touching the handlers.
+type Server struct {
+	fsys fs.FS
+
+	idleTimeout   time.Duration
+	headerTimeout time.Duration
+	writeTimeout  time.Duration
+	encoders      []Encoder
+}
+
+// Option configures a Server at construction time.
+type Option func(*Server)
+
+// WithIdleTimeout overrides how long a keep-alive connection may sit between
+// requests before the server closes it.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) { s.idleTimeout = d }
+}
+
+// WithHeaderTimeout overrides how long the server waits for a request line
+// and headers to arrive once a request starts.
+func WithHeaderTimeout(d time.Duration) Option {
+	return func(s *Server) { s.headerTimeout = d }
+}
+
+// WithWriteTimeout overrides how long a single write of response data may
+// take before the connection is abandoned. Streaming responses refresh this
+// deadline before each chunk, so it bounds how long a stalled client can hang
+// a write rather than capping the response's total transfer time.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) { s.writeTimeout = d }
+}
+
+// WithEncoders overrides the Content-Encoding codecs negotiated against
+// Accept-Encoding, replacing the gzip/deflate/br defaults.
+func WithEncoders(encoders ...Encoder) Option {
+	return func(s *Server) { s.encoders = encoders }
+}
+
+// NewServer builds a Server around fsys, leaving main free to just wire flags
+// and listeners together.
+func NewServer(fsys fs.FS, opts ...Option) *Server {
+	server := &Server{
+		fsys:          fsys,
+		idleTimeout:   defaultIdleTimeout,
+		headerTimeout: defaultHeaderTimeout,
+		writeTimeout:  defaultWriteTimeout,
+		encoders:      defaultEncoders(),
+	}
+	for _, opt := range opts {
+		opt(server)
+	}
+	return server
+}
+
+func (s *Server) encoderByName(name string) (Encoder, bool) {
+	for _, encoder := range s.encoders {
+		if encoder.Name() == name {
+			return encoder, true
+		}
+	}
+	return nil, false
+}
+
+// acceptedEncoding is one comma-separated entry of an Accept-Encoding header,
+// e.g. "gzip;q=0.8".
+type acceptedEncoding struct {
+	name string
+	q    float64
+}
+
+func parseAcceptEncoding(header string) []acceptedEncoding {
+	if header == "" {
+		return nil
+	}
+
+	parts := strings.Split(header, ",")
+	accepted := make([]acceptedEncoding, 0, len(parts))
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, q := part, 1.0
+		if idx := strings.IndexByte(part, ';'); idx >= 0 {
+			name = strings.TrimSpace(part[:idx])
+			for _, param := range strings.Split(part[idx+1:], ";") {
+				param = strings.TrimSpace(param)
+				if value, ok := strings.CutPrefix(param, "q="); ok {
+					if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+						q = parsed
+					}
+				}
+			}
+		}
+
+		accepted = append(accepted, acceptedEncoding{name: strings.ToLower(name), q: q})
+	}
+	return accepted
+}
+
+// chooseEncoding picks the highest-q encoding from header that s has a
+// registered Encoder for, honoring "identity", "*", and "q=0" as an explicit
+// rejection of that coding. It returns nil when no compression should be
+// applied, which callers treat as "send the body as-is".
+func (s *Server) chooseEncoding(header string) Encoder {
+	accepted := parseAcceptEncoding(header)
+	if len(accepted) == 0 {
+		return nil
+	}
+
+	rejected := make(map[string]bool, len(accepted))
+	wildcardQ := -1.0
+	var best Encoder
+	bestQ := 0.0
+
+	for _, candidate := range accepted {
+		switch candidate.name {
+		case "*":
+			wildcardQ = candidate.q
+			continue
+		case "identity":
+			continue
+		}
+		if candidate.q == 0 {
+			rejected[candidate.name] = true
+			continue
+		}
+		encoder, ok := s.encoderByName(candidate.name)
+		if !ok {
+			continue
+		}
+		if candidate.q > bestQ {
+			best, bestQ = encoder, candidate.q
+		}
+	}
+
+	if best != nil {
+		return best
+	}
+
+	if wildcardQ > 0 {
+		for _, encoder := range s.encoders {
+			if !rejected[encoder.Name()] {
+				return encoder
+			}
+		}
+	}
+
+	return nil
+}
+
+// connectionHeader renders the Connection header value for a response,
+// matching whatever keep-alive decision the caller made for the request.
+func connectionHeader(keepAlive bool) string {
+	if keepAlive {
+		return "keep-alive"
+	}
+	return "close"
+}
+
+// deadlineWriter wraps a net.Conn so every Write refreshes the connection's
+// write deadline first, giving a multi-chunk transfer writeTimeout per chunk
+// rather than one deadline shared across the whole response - otherwise a
+// large file, range, or archive legitimately taking longer than a single
+// deadline to send would have its writes start failing partway through with
+// nothing checking for it, silently truncating the body. It's an io.Writer
+// so it can be handed to anything that streams into conn, such as
+// io.CopyN or httputil.NewChunkedWriter.
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.conn.Write(p)
+}
+
+// writeChunk is deadlineWriter.Write for callers that just want to write one
+// buffer without constructing a writer.
+func writeChunk(conn net.Conn, writeTimeout time.Duration, p []byte) error {
+	_, err := (deadlineWriter{conn: conn, timeout: writeTimeout}).Write(p)
+	return err
+}
+
+func HttpResponse(conn net.Conn, status string, body []byte, contentType string, encoder Encoder, keepAlive bool) {
 	statusLine := "HTTP/1.1 " + status + "\r\n"
-	headers := "Content-Type: " + contentType + "\r\n"
-	if contentEncoding != nil {
-		headers += "Content-Encoding: " + *contentEncoding + "\r\n"
+	headers := "Content-Type: " + contentType + "\r\n" +
+		"Connection: " + connectionHeader(keepAlive) + "\r\n"
+	if encoder != nil {
+		headers += "Content-Encoding: " + encoder.Name() + "\r\n"
 	}
 
 	if body != nil {
-		var compressedBody []byte
-		if contentEncoding != nil && *contentEncoding == "gzip" {
+		var encodedBody []byte
+		if encoder != nil {
 			var buf bytes.Buffer
-			gw := gzip.NewWriter(&buf)
-			_, err := gw.Write(body)
-			if err != nil {
+			writer := encoder.NewWriter(&buf)
+			if _, err := writer.Write(body); err != nil {
 				fmt.Println("Error compressing response body:", err)
 				conn.Write([]byte(statusLine + headers + "\r\n"))
 				conn.Write(body)
 				return
 			}
-			gw.Close()
-			compressedBody = buf.Bytes()
+			writer.Close()
+			encodedBody = buf.Bytes()
 		} else {
-			compressedBody = body
+			encodedBody = body
 		}
 
-		bodyLength := strconv.Itoa(len(compressedBody))
+		bodyLength := strconv.Itoa(len(encodedBody))
 		headers += "Content-Length: " + bodyLength + "\r\n\r\n"
 		conn.Write([]byte(statusLine + headers))
-		conn.Write(compressedBody)
+		conn.Write(encodedBody)
 	} else {
 		headers += "\r\n"
 		conn.Write([]byte(statusLine + headers))
@@ -67,6 +391,10 @@ func GetPathSegments(request *http.Request) []string {
 	})
 }
 
+// ProcessPath validates the request's leading path segment against the
+// handlers this server knows about. Everything under "files/" is returned in
+// full - not just the next segment - so handleFiles can resolve nested paths
+// like files/subdir/name.txt instead of only ever seeing "subdir".
 func ProcessPath(request *http.Request) ([]string, error) {
 	segments := GetPathSegments(request)
 	validPaths := map[string]struct{}{
@@ -79,149 +407,679 @@ func ProcessPath(request *http.Request) ([]string, error) {
 		return []string{}, nil
 	}
 
-	if _, exists := validPaths[segments[0]]; exists {
-		if len(segments) > 1 {
-			return segments[:2], nil
-		}
-		return segments[:1], nil
+	if _, exists := validPaths[segments[0]]; !exists {
+		return nil, errors.New("invalid path")
 	}
 
-	return nil, errors.New("invalid path")
+	if segments[0] == "files" {
+		return segments, nil
+	}
+	if len(segments) > 1 {
+		return segments[:2], nil
+	}
+	return segments[:1], nil
 }
 
-func Handler(conn net.Conn, directory string) {
+// shouldKeepAlive applies RFC 7230's default Connection semantics: HTTP/1.1
+// requests are persistent unless they say "Connection: close", HTTP/1.0
+// requests are closed unless they say "Connection: keep-alive".
+func shouldKeepAlive(request *http.Request) bool {
+	connHeader := strings.ToLower(strings.TrimSpace(request.Header.Get("Connection")))
+	if request.ProtoAtLeast(1, 1) {
+		return connHeader != "close"
+	}
+	return connHeader == "keep-alive"
+}
+
+// Handler serves every request on conn in a loop, keeping the connection
+// open between requests per shouldKeepAlive until the client asks to close,
+// a read/write deadline trips, or the connection is dropped.
+func (s *Server) Handler(conn net.Conn) {
 	defer conn.Close()
 
-	request, err := http.ReadRequest(bufio.NewReader(conn))
-	if err != nil {
-		fmt.Println("Error reading request:", err)
-		HttpResponse(conn, StatusInternalServerError, nil, contentTypePlainText, nil)
-		return
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+		if _, err := reader.Peek(1); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(s.headerTimeout))
+
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			fmt.Println("Error reading request:", err)
+			return
+		}
+
+		keepAlive := shouldKeepAlive(request)
+		conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+		s.serve(conn, request, keepAlive)
+		io.Copy(io.Discard, request.Body)
+
+		if !keepAlive {
+			return
+		}
 	}
+}
 
+func (s *Server) serve(conn net.Conn, request *http.Request, keepAlive bool) {
 	pathSegments, err := ProcessPath(request)
 	if err != nil {
-		HttpResponse(conn, StatusNotFound, nil, contentTypePlainText, nil)
+		HttpResponse(conn, StatusNotFound, nil, contentTypePlainText, nil, keepAlive)
 		return
 	}
 
 	if len(pathSegments) == 0 {
-		HttpResponse(conn, StatusOK, nil, contentTypePlainText, nil)
+		HttpResponse(conn, StatusOK, nil, contentTypePlainText, nil, keepAlive)
 		return
 	}
 
-	supportedEncodings := []string{"gzip"}
-
-	acceptEncoding := request.Header.Get("Accept-Encoding")
-	acceptedEncodings := strings.Split(acceptEncoding, ",")
-
-	var contentEncoding *string
-	for _, accepted := range acceptedEncodings {
-		accepted = strings.TrimSpace(accepted)
-		for _, supported := range supportedEncodings {
-			if accepted == supported {
-				contentEncoding = &accepted
-				break
-			}
-		}
-		if contentEncoding != nil {
-			break
-		}
-	}
+	encoder := s.chooseEncoding(request.Header.Get("Accept-Encoding"))
 
 	switch pathSegments[0] {
 	case "echo":
-		handleEcho(conn, pathSegments, contentEncoding)
+		handleEcho(conn, pathSegments, encoder, keepAlive)
 	case "user-agent":
-		handleUserAgent(conn, request, contentEncoding)
+		handleUserAgent(conn, request, encoder, keepAlive)
 	case "files":
-		handleFiles(conn, request, directory, pathSegments, contentEncoding)
+		s.handleFiles(conn, request, pathSegments, encoder, keepAlive)
 	default:
-		HttpResponse(conn, StatusNotFound, nil, contentTypePlainText, nil)
+		HttpResponse(conn, StatusNotFound, nil, contentTypePlainText, nil, keepAlive)
 	}
 }
 
-func handleEcho(conn net.Conn, pathSegments []string, contentEncoding *string) {
+func handleEcho(conn net.Conn, pathSegments []string, encoder Encoder, keepAlive bool) {
 	if len(pathSegments) > 1 {
 		responseBody := []byte(pathSegments[1])
-		HttpResponse(conn, StatusOK, responseBody, contentTypePlainText, contentEncoding)
+		HttpResponse(conn, StatusOK, responseBody, contentTypePlainText, encoder, keepAlive)
 	} else {
-		HttpResponse(conn, StatusOK, nil, contentTypePlainText, contentEncoding)
+		HttpResponse(conn, StatusOK, nil, contentTypePlainText, encoder, keepAlive)
 	}
 }
 
-func handleUserAgent(conn net.Conn, request *http.Request, contentEncoding *string) {
+func handleUserAgent(conn net.Conn, request *http.Request, encoder Encoder, keepAlive bool) {
 	userAgentData := request.UserAgent()
 	responseBody := []byte(userAgentData)
-	HttpResponse(conn, StatusOK, responseBody, contentTypePlainText, contentEncoding)
+	HttpResponse(conn, StatusOK, responseBody, contentTypePlainText, encoder, keepAlive)
 }
 
-func handleFiles(conn net.Conn, request *http.Request, directory string, pathSegments []string, contentEncoding *string) {
-	if len(pathSegments) < 2 {
-		HttpResponse(conn, StatusNotFound, nil, contentTypePlainText, nil)
-		return
+func (s *Server) handleFiles(conn net.Conn, request *http.Request, pathSegments []string, encoder Encoder, keepAlive bool) {
+	name := "."
+	if len(pathSegments) > 1 {
+		name = strings.Join(pathSegments[1:], "/")
 	}
-	filePath := filepath.Join(directory, pathSegments[1])
 
 	switch request.Method {
 	case http.MethodGet:
-		file, err := os.Open(filePath)
+		file, err := s.fsys.Open(name)
 		if err != nil {
-			HttpResponse(conn, StatusNotFound, nil, contentTypePlainText, nil)
+			HttpResponse(conn, StatusNotFound, nil, contentTypePlainText, nil, keepAlive)
 			return
 		}
 		defer file.Close()
 
 		fileInfo, err := file.Stat()
 		if err != nil {
-			HttpResponse(conn, StatusInternalServerError, nil, contentTypePlainText, nil)
+			HttpResponse(conn, StatusInternalServerError, nil, contentTypePlainText, nil, keepAlive)
 			return
 		}
 
+		if fileInfo.IsDir() {
+			file.Close()
+			s.handleDirectory(conn, request, name, keepAlive)
+			return
+		}
+
+		etag := weakETag(fileInfo)
+		lastModified := fileInfo.ModTime().UTC().Format(http.TimeFormat)
+		contentType := detectContentType(file, name)
+
+		if isNotModified(request, etag, fileInfo.ModTime()) {
+			headers := "HTTP/1.1 " + StatusNotModified + "\r\n" +
+				"Accept-Ranges: bytes\r\n" +
+				"ETag: " + etag + "\r\n" +
+				"Last-Modified: " + lastModified + "\r\n" +
+				"Connection: " + connectionHeader(keepAlive) + "\r\n\r\n"
+			conn.Write([]byte(headers))
+			return
+		}
+
+		rangeHeader := request.Header.Get("Range")
+
+		if encoder != nil && rangeHeader == "" {
+			if suffix, ok := precompressedSuffixes[encoder.Name()]; ok {
+				if s.servePrecompressed(conn, name, suffix, encoder.Name(), fileInfo, contentType, etag, lastModified, keepAlive) {
+					return
+				}
+			}
+		}
+
+		if rangeHeader == "" {
+			writeFullFile(conn, file, fileInfo, contentType, etag, lastModified, encoder, keepAlive, s.writeTimeout)
+			return
+		}
+
+		ranges, err := parseRangeHeader(rangeHeader, fileInfo.Size())
+		if err != nil {
+			writeFullFile(conn, file, fileInfo, contentType, etag, lastModified, encoder, keepAlive, s.writeTimeout)
+			return
+		}
+		if len(ranges) == 0 {
+			headers := "HTTP/1.1 " + StatusRangeNotSatisfiable + "\r\n" +
+				"Content-Range: bytes */" + strconv.FormatInt(fileInfo.Size(), 10) + "\r\n" +
+				"Connection: " + connectionHeader(keepAlive) + "\r\n\r\n"
+			conn.Write([]byte(headers))
+			return
+		}
+		if len(ranges) == 1 {
+			writeSingleRange(conn, file, fileInfo, ranges[0], contentType, etag, lastModified, keepAlive, s.writeTimeout)
+			return
+		}
+		writeMultipartRanges(conn, file, fileInfo, ranges, contentType, etag, lastModified, keepAlive, s.writeTimeout)
+
+	case http.MethodPost:
+		writeFS, ok := s.fsys.(WriteFS)
+		if !ok {
+			HttpResponse(conn, StatusInternalServerError, nil, contentTypePlainText, nil, keepAlive)
+			return
+		}
+		fileContents, err := io.ReadAll(request.Body)
+		if err != nil {
+			HttpResponse(conn, StatusInternalServerError, nil, contentTypePlainText, nil, keepAlive)
+			return
+		}
+		err = writeFS.WriteFile(name, fileContents, 0644)
+		if err != nil {
+			HttpResponse(conn, StatusInternalServerError, nil, contentTypePlainText, nil, keepAlive)
+			return
+		}
+		HttpResponse(conn, StatusCreated, nil, contentTypePlainText, nil, keepAlive)
+
+	default:
+		HttpResponse(conn, StatusNotFound, nil, contentTypePlainText, nil, keepAlive)
+	}
+}
+
+// directoryEntry is the JSON shape of one row in a directory listing.
+type directoryEntry struct {
+	Name  string `json:"name"`
+	IsDir bool   `json:"is_dir"`
+}
+
+// handleDirectory serves a GET against a path that resolves to a directory:
+// an archive download when ?archive=tar.gz or ?archive=zip is present,
+// otherwise a listing negotiated on the Accept header.
+func (s *Server) handleDirectory(conn net.Conn, request *http.Request, name string, keepAlive bool) {
+	switch archiveFormat := request.URL.Query().Get("archive"); archiveFormat {
+	case "":
+		s.writeDirectoryListing(conn, request, name, keepAlive)
+	case "tar.gz":
+		s.streamTarGzArchive(conn, name, keepAlive)
+	case "zip":
+		s.streamZipArchive(conn, name, keepAlive)
+	default:
+		HttpResponse(conn, StatusNotFound, nil, contentTypePlainText, nil, keepAlive)
+	}
+}
+
+func (s *Server) writeDirectoryListing(conn net.Conn, request *http.Request, name string, keepAlive bool) {
+	dirEntries, err := fs.ReadDir(s.fsys, name)
+	if err != nil {
+		HttpResponse(conn, StatusInternalServerError, nil, contentTypePlainText, nil, keepAlive)
+		return
+	}
+
+	entries := make([]directoryEntry, len(dirEntries))
+	for i, entry := range dirEntries {
+		entries[i] = directoryEntry{Name: entry.Name(), IsDir: entry.IsDir()}
+	}
+
+	if strings.Contains(request.Header.Get("Accept"), "application/json") {
+		body, err := json.Marshal(entries)
+		if err != nil {
+			HttpResponse(conn, StatusInternalServerError, nil, contentTypePlainText, nil, keepAlive)
+			return
+		}
+		HttpResponse(conn, StatusOK, body, "application/json", nil, keepAlive)
+		return
+	}
+
+	HttpResponse(conn, StatusOK, renderDirectoryListingHTML(entries), "text/html", nil, keepAlive)
+}
+
+func renderDirectoryListingHTML(entries []directoryEntry) []byte {
+	var body bytes.Buffer
+	body.WriteString("<!DOCTYPE html>\n<ul>\n")
+	for _, entry := range entries {
+		display := entry.Name
+		if entry.IsDir {
+			display += "/"
+		}
+		escaped := html.EscapeString(display)
+		body.WriteString("<li><a href=\"" + escaped + "\">" + escaped + "</a></li>\n")
+	}
+	body.WriteString("</ul>\n")
+	return body.Bytes()
+}
+
+// streamTarGzArchive walks the directory at name and streams it as a gzipped
+// tar, chunk by chunk, since the final size isn't known ahead of time.
+func (s *Server) streamTarGzArchive(conn net.Conn, name string, keepAlive bool) {
+	headers := "HTTP/1.1 " + StatusOK + "\r\n" +
+		"Content-Type: application/gzip\r\n" +
+		"Content-Disposition: attachment; filename=\"" + filepath.Base(name) + ".tar.gz\"\r\n" +
+		"Connection: " + connectionHeader(keepAlive) + "\r\n" +
+		"Transfer-Encoding: chunked\r\n\r\n"
+	if err := writeChunk(conn, s.writeTimeout, []byte(headers)); err != nil {
+		fmt.Println("Error writing response headers:", err)
+		return
+	}
+
+	chunkedWriter := httputil.NewChunkedWriter(deadlineWriter{conn: conn, timeout: s.writeTimeout})
+	defer chunkedWriter.Close()
+	gzipWriter := gzip.NewWriter(chunkedWriter)
+	defer gzipWriter.Close()
+	tarWriter := tar.NewWriter(gzipWriter)
+	defer tarWriter.Close()
+
+	err := fs.WalkDir(s.fsys, name, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == name {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		relName, err := filepath.Rel(name, path)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relName)
+		if entry.IsDir() {
+			header.Name += "/"
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		file, err := s.fsys.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tarWriter, file)
+		return err
+	})
+	if err != nil {
+		fmt.Println("Error streaming tar.gz archive:", err)
+	}
+}
+
+// streamZipArchive walks the directory at name and streams it as a zip,
+// chunk by chunk, since the final size isn't known ahead of time.
+func (s *Server) streamZipArchive(conn net.Conn, name string, keepAlive bool) {
+	headers := "HTTP/1.1 " + StatusOK + "\r\n" +
+		"Content-Type: application/zip\r\n" +
+		"Content-Disposition: attachment; filename=\"" + filepath.Base(name) + ".zip\"\r\n" +
+		"Connection: " + connectionHeader(keepAlive) + "\r\n" +
+		"Transfer-Encoding: chunked\r\n\r\n"
+	if err := writeChunk(conn, s.writeTimeout, []byte(headers)); err != nil {
+		fmt.Println("Error writing response headers:", err)
+		return
+	}
+
+	chunkedWriter := httputil.NewChunkedWriter(deadlineWriter{conn: conn, timeout: s.writeTimeout})
+	defer chunkedWriter.Close()
+	zipWriter := zip.NewWriter(chunkedWriter)
+	defer zipWriter.Close()
+
+	err := fs.WalkDir(s.fsys, name, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == name || entry.IsDir() {
+			return err
+		}
+
+		relName, err := filepath.Rel(name, path)
+		if err != nil {
+			return err
+		}
+		entryWriter, err := zipWriter.Create(filepath.ToSlash(relName))
+		if err != nil {
+			return err
+		}
+
+		file, err := s.fsys.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(entryWriter, file)
+		return err
+	})
+	if err != nil {
+		fmt.Println("Error streaming zip archive:", err)
+	}
+}
+
+// weakETag derives a weak validator from the file's size and modification
+// time, cheap enough to recompute on every request without hashing the body.
+func weakETag(fileInfo fs.FileInfo) string {
+	return fmt.Sprintf(`W/"%x-%x"`, fileInfo.Size(), fileInfo.ModTime().UnixNano())
+}
+
+// detectContentType sniffs file's first 512 bytes with http.DetectContentType
+// and falls back to an extension-based mime.TypeByExtension lookup when
+// sniffing is unavailable (the backend's file doesn't support seeking) or
+// inconclusive (DetectContentType's own generic fallback).
+func detectContentType(file fs.File, name string) string {
+	if sniffed, ok := sniffContentType(file); ok && sniffed != contentTypeOctetStream {
+		return sniffed
+	}
+	if ext := filepath.Ext(name); ext != "" {
+		if mimeType := mime.TypeByExtension(ext); mimeType != "" {
+			return mimeType
+		}
+	}
+	return contentTypeOctetStream
+}
+
+func sniffContentType(file fs.File) (string, bool) {
+	seeker, ok := file.(io.Seeker)
+	if !ok {
+		return "", false
+	}
+	buffer := make([]byte, 512)
+	n, err := file.Read(buffer)
+	if err != nil && err != io.EOF {
+		return "", false
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return "", false
+	}
+	return http.DetectContentType(buffer[:n]), true
+}
+
+// servePrecompressed looks for a sibling file (e.g. "style.css.gz") holding a
+// pre-compressed copy of the file being served, and, if it exists and is at
+// least as new as the original, streams it directly with the matching
+// Content-Encoding so the server can skip compressing on every request. It
+// reports whether such a variant was found and served. Callers must only
+// take this path for whole-file requests - the precompressed sibling isn't
+// addressable by byte range, so a Range request has to fall through to the
+// range-aware handling of the original file instead.
+func (s *Server) servePrecompressed(conn net.Conn, name, suffix, encoding string, fileInfo fs.FileInfo, contentType, etag, lastModified string, keepAlive bool) bool {
+	compressedFile, err := s.fsys.Open(name + suffix)
+	if err != nil {
+		return false
+	}
+	defer compressedFile.Close()
+
+	compressedInfo, err := compressedFile.Stat()
+	if err != nil || compressedInfo.ModTime().Before(fileInfo.ModTime()) {
+		return false
+	}
+
+	headers := "HTTP/1.1 " + StatusOK + "\r\n" +
+		"Content-Type: " + contentType + "\r\n" +
+		"Content-Encoding: " + encoding + "\r\n" +
+		"Accept-Ranges: bytes\r\n" +
+		"ETag: " + etag + "\r\n" +
+		"Last-Modified: " + lastModified + "\r\n" +
+		"Connection: " + connectionHeader(keepAlive) + "\r\n" +
+		"Content-Length: " + strconv.FormatInt(compressedInfo.Size(), 10) + "\r\n\r\n"
+	writeChunk(conn, s.writeTimeout, []byte(headers))
+
+	buffer := make([]byte, bufferSize)
+	for {
+		n, err := compressedFile.Read(buffer)
+		if err != nil && err != io.EOF {
+			fmt.Println("Error reading precompressed file:", err)
+			return true
+		}
+		if n == 0 {
+			break
+		}
+		if err := writeChunk(conn, s.writeTimeout, buffer[:n]); err != nil {
+			fmt.Println("Error writing precompressed file:", err)
+			return true
+		}
+	}
+	return true
+}
+
+func isNotModified(request *http.Request, etag string, modTime time.Time) bool {
+	if inm := request.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			if strings.TrimSpace(candidate) == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := request.Header.Get("If-Modified-Since"); ims != "" {
+		if since, err := http.ParseTime(ims); err == nil {
+			return !modTime.Truncate(time.Second).After(since)
+		}
+	}
+	return false
+}
+
+// parseRangeHeader parses a "Range: bytes=..." header into zero or more
+// inclusive [start, end] pairs clamped to size. A syntactically malformed
+// header is reported as an error so the caller can fall back to serving the
+// full file, per RFC 7233. A syntactically valid header whose ranges are all
+// out of bounds yields an empty, non-nil slice so the caller can answer 416.
+func parseRangeHeader(rangeHeader string, size int64) ([][2]int64, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(rangeHeader, prefix) {
+		return nil, errors.New("unsupported range unit")
+	}
+
+	specs := strings.Split(strings.TrimPrefix(rangeHeader, prefix), ",")
+	ranges := make([][2]int64, 0, len(specs))
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		dash := strings.IndexByte(spec, '-')
+		if dash < 0 {
+			return nil, errors.New("malformed range")
+		}
+		startStr, endStr := spec[:dash], spec[dash+1:]
+
+		var start, end int64
+		switch {
+		case startStr == "" && endStr == "":
+			return nil, errors.New("malformed range")
+		case startStr == "":
+			suffixLength, err := strconv.ParseInt(endStr, 10, 64)
+			if err != nil || suffixLength <= 0 {
+				return nil, errors.New("malformed range")
+			}
+			if suffixLength > size {
+				suffixLength = size
+			}
+			start, end = size-suffixLength, size-1
+		case endStr == "":
+			s, err := strconv.ParseInt(startStr, 10, 64)
+			if err != nil {
+				return nil, errors.New("malformed range")
+			}
+			start, end = s, size-1
+		default:
+			s, err := strconv.ParseInt(startStr, 10, 64)
+			if err != nil {
+				return nil, errors.New("malformed range")
+			}
+			e, err := strconv.ParseInt(endStr, 10, 64)
+			if err != nil {
+				return nil, errors.New("malformed range")
+			}
+			start, end = s, e
+		}
+
+		if start < 0 || start > end || start >= size {
+			continue
+		}
+		if end >= size {
+			end = size - 1
+		}
+		ranges = append(ranges, [2]int64{start, end})
+	}
+
+	return ranges, nil
+}
+
+// writeFullFile streams the whole file as the response body. When encoder is
+// non-nil, the file is compressed into a buffer first so Content-Length
+// reflects the encoded size rather than the file's own size on disk -
+// previously this function advertised Content-Encoding without actually
+// compressing anything, corrupting the response for any client that took
+// the header at its word. writeTimeout bounds each individual conn.Write,
+// refreshed via writeChunk, rather than the transfer as a whole.
+func writeFullFile(conn net.Conn, file fs.File, fileInfo fs.FileInfo, contentType, etag, lastModified string, encoder Encoder, keepAlive bool, writeTimeout time.Duration) {
+	if encoder == nil {
 		headers := "HTTP/1.1 " + StatusOK + "\r\n" +
-			"Content-Type: " + contentTypeOctetStream + "\r\n" +
-			"Content-Length: " + strconv.FormatInt(fileInfo.Size(), 10) + "\r\n"
-		if contentEncoding != nil {
-			headers += "Content-Encoding: " + *contentEncoding + "\r\n"
+			"Content-Type: " + contentType + "\r\n" +
+			"Accept-Ranges: bytes\r\n" +
+			"ETag: " + etag + "\r\n" +
+			"Last-Modified: " + lastModified + "\r\n" +
+			"Connection: " + connectionHeader(keepAlive) + "\r\n" +
+			"Content-Length: " + strconv.FormatInt(fileInfo.Size(), 10) + "\r\n\r\n"
+		if err := writeChunk(conn, writeTimeout, []byte(headers)); err != nil {
+			fmt.Println("Error writing response headers:", err)
+			return
 		}
-		headers += "\r\n"
-		conn.Write([]byte(headers))
 
 		buffer := make([]byte, bufferSize)
 		for {
 			n, err := file.Read(buffer)
 			if err != nil && err != io.EOF {
-				HttpResponse(conn, StatusInternalServerError, nil, contentTypePlainText, nil)
+				fmt.Println("Error reading file:", err)
 				return
 			}
 			if n == 0 {
 				break
 			}
-			conn.Write(buffer[:n])
+			if err := writeChunk(conn, writeTimeout, buffer[:n]); err != nil {
+				fmt.Println("Error writing file:", err)
+				return
+			}
 		}
+		return
+	}
 
-	case http.MethodPost:
-		fileContents, err := io.ReadAll(request.Body)
-		if err != nil {
-			HttpResponse(conn, StatusInternalServerError, nil, contentTypePlainText, nil)
-			return
-		}
-		err = os.WriteFile(filePath, fileContents, 0644)
-		if err != nil {
-			HttpResponse(conn, StatusInternalServerError, nil, contentTypePlainText, nil)
+	var encoded bytes.Buffer
+	writer := encoder.NewWriter(&encoded)
+	if _, err := io.Copy(writer, file); err != nil {
+		fmt.Println("Error compressing file:", err)
+		return
+	}
+	if err := writer.Close(); err != nil {
+		fmt.Println("Error compressing file:", err)
+		return
+	}
+
+	headers := "HTTP/1.1 " + StatusOK + "\r\n" +
+		"Content-Type: " + contentType + "\r\n" +
+		"Content-Encoding: " + encoder.Name() + "\r\n" +
+		"Accept-Ranges: bytes\r\n" +
+		"ETag: " + etag + "\r\n" +
+		"Last-Modified: " + lastModified + "\r\n" +
+		"Connection: " + connectionHeader(keepAlive) + "\r\n" +
+		"Content-Length: " + strconv.Itoa(encoded.Len()) + "\r\n\r\n"
+	if err := writeChunk(conn, writeTimeout, []byte(headers)); err != nil {
+		fmt.Println("Error writing response headers:", err)
+		return
+	}
+	if err := writeChunk(conn, writeTimeout, encoded.Bytes()); err != nil {
+		fmt.Println("Error writing file:", err)
+		return
+	}
+}
+
+func writeSingleRange(conn net.Conn, file fs.File, fileInfo fs.FileInfo, byteRange [2]int64, contentType, etag, lastModified string, keepAlive bool, writeTimeout time.Duration) {
+	start, end := byteRange[0], byteRange[1]
+	length := end - start + 1
+
+	headers := "HTTP/1.1 " + StatusPartialContent + "\r\n" +
+		"Content-Type: " + contentType + "\r\n" +
+		"Accept-Ranges: bytes\r\n" +
+		"ETag: " + etag + "\r\n" +
+		"Last-Modified: " + lastModified + "\r\n" +
+		"Connection: " + connectionHeader(keepAlive) + "\r\n" +
+		"Content-Range: bytes " + strconv.FormatInt(start, 10) + "-" + strconv.FormatInt(end, 10) + "/" + strconv.FormatInt(fileInfo.Size(), 10) + "\r\n" +
+		"Content-Length: " + strconv.FormatInt(length, 10) + "\r\n\r\n"
+	if err := writeChunk(conn, writeTimeout, []byte(headers)); err != nil {
+		fmt.Println("Error writing response headers:", err)
+		return
+	}
+
+	if err := streamFileRange(deadlineWriter{conn: conn, timeout: writeTimeout}, file, start, length); err != nil {
+		fmt.Println("Error streaming file range:", err)
+	}
+}
+
+func writeMultipartRanges(conn net.Conn, file fs.File, fileInfo fs.FileInfo, ranges [][2]int64, contentType, etag, lastModified string, keepAlive bool, writeTimeout time.Duration) {
+	var body bytes.Buffer
+	for _, byteRange := range ranges {
+		start, end := byteRange[0], byteRange[1]
+		body.WriteString("--" + multipartBoundary + "\r\n")
+		body.WriteString("Content-Type: " + contentType + "\r\n")
+		body.WriteString("Content-Range: bytes " + strconv.FormatInt(start, 10) + "-" + strconv.FormatInt(end, 10) + "/" + strconv.FormatInt(fileInfo.Size(), 10) + "\r\n\r\n")
+		if err := streamFileRange(&body, file, start, end-start+1); err != nil {
+			fmt.Println("Error building multipart range body:", err)
 			return
 		}
-		HttpResponse(conn, StatusCreated, nil, contentTypePlainText, nil)
+		body.WriteString("\r\n")
+	}
+	body.WriteString("--" + multipartBoundary + "--\r\n")
 
-	default:
-		HttpResponse(conn, StatusNotFound, nil, contentTypePlainText, nil)
+	headers := "HTTP/1.1 " + StatusPartialContent + "\r\n" +
+		"Content-Type: multipart/byteranges; boundary=" + multipartBoundary + "\r\n" +
+		"Accept-Ranges: bytes\r\n" +
+		"ETag: " + etag + "\r\n" +
+		"Last-Modified: " + lastModified + "\r\n" +
+		"Connection: " + connectionHeader(keepAlive) + "\r\n" +
+		"Content-Length: " + strconv.Itoa(body.Len()) + "\r\n\r\n"
+	if err := writeChunk(conn, writeTimeout, []byte(headers)); err != nil {
+		fmt.Println("Error writing response headers:", err)
+		return
+	}
+	if err := writeChunk(conn, writeTimeout, body.Bytes()); err != nil {
+		fmt.Println("Error writing multipart range body:", err)
 	}
 }
 
+// streamFileRange seeks file to start and copies length bytes to dst via
+// io.CopyN, returning any error encountered along the way. fs.FS only
+// guarantees Read and Close, so backends whose files don't support seeking
+// (and therefore can't serve ranges) report that plainly instead of silently
+// returning garbage.
+func streamFileRange(dst io.Writer, file fs.File, start, length int64) error {
+	seeker, ok := file.(io.Seeker)
+	if !ok {
+		return errors.New("file does not support seeking, range requests unavailable")
+	}
+	if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.CopyN(dst, file, length)
+	return err
+}
+
 func main() {
 	directory := flag.String("directory", ".", "The directory to serve files from")
+	maxConns := flag.Int("max-conns", 100, "Maximum number of concurrent connections")
 	flag.Parse()
 
+	server := NewServer(newDirFS(*directory))
+
 	listener, err := net.Listen("tcp", "0.0.0.0:4221")
 	if err != nil {
 		fmt.Println("Failed to bind to port 4221:", err)
@@ -231,12 +1089,17 @@ func main() {
 
 	fmt.Println("Server is listening on port 4221")
 
+	connSlots := make(chan struct{}, *maxConns)
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			fmt.Println("Error accepting connection:", err)
 			continue
 		}
-		go Handler(conn, *directory)
+		connSlots <- struct{}{}
+		go func() {
+			defer func() { <-connSlots }()
+			server.Handler(conn)
+		}()
 	}
 }